@@ -0,0 +1,85 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	activeCapturesGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "pcap_active_captures",
+		Help: "Number of capture sessions currently streaming.",
+	})
+	bytesStreamedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "pcap_bytes_streamed_total",
+		Help: "Total bytes streamed to clients across all capture sessions.",
+	})
+	streamErrorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "pcap_stream_errors_total",
+		Help: "Total number of capture streams that ended in an error.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(activeCapturesGauge, bytesStreamedTotal, streamErrorsTotal)
+}
+
+// captureLimiter enforces MaxConcurrentCapturesPerToken and
+// MaxConcurrentCapturesGlobal. A limit of zero or less is treated as
+// unlimited.
+type captureLimiter struct {
+	mu          sync.Mutex
+	perToken    map[string]int
+	global      int
+	maxPerToken int
+	maxGlobal   int
+}
+
+func newCaptureLimiter(maxPerToken int, maxGlobal int) *captureLimiter {
+	return &captureLimiter{
+		perToken:    make(map[string]int),
+		maxPerToken: maxPerToken,
+		maxGlobal:   maxGlobal,
+	}
+}
+
+// acquire reserves one capture slot for the given token hash. It returns
+// false if the caller should be rejected (the handler is expected to
+// respond with 429 Too Many Requests in that case).
+func (l *captureLimiter) acquire(tokenHash string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxGlobal > 0 && l.global >= l.maxGlobal {
+		return false
+	}
+	if l.maxPerToken > 0 && l.perToken[tokenHash] >= l.maxPerToken {
+		return false
+	}
+
+	l.global++
+	l.perToken[tokenHash]++
+	activeCapturesGauge.Inc()
+
+	return true
+}
+
+// release gives back a slot acquired with acquire. It must be called
+// exactly once for every acquire that returned true, from every exit path
+// of the capture handler.
+func (l *captureLimiter) release(tokenHash string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.global > 0 {
+		l.global--
+	}
+	if l.perToken[tokenHash] > 0 {
+		l.perToken[tokenHash]--
+		if l.perToken[tokenHash] == 0 {
+			delete(l.perToken, tokenHash)
+		}
+	}
+	activeCapturesGauge.Dec()
+}
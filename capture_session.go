@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/domdom82/pcap-server-api/cfclient"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// packetMessage is a single packet (or end-of-stream marker) produced by one
+// per-index capture worker and merged into a session's output stream. err
+// is set on the end-of-stream marker when the worker ended because of an
+// error: it failed to reach the app or the upstream pcap-server, or reading
+// the upstream stream failed part way through. A caller that has not written
+// a response status yet uses it to report a failure that happened before
+// any packet arrived instead of silently returning an empty 200 OK.
+type packetMessage struct {
+	packet gopacket.Packet
+	index  int
+	done   bool
+	err    error
+}
+
+// indexStats tracks the running totals for a single app index within a
+// capture session. All fields are updated with the atomic package so they
+// can be read concurrently by the /stats endpoint and in-band stats frames.
+type indexStats struct {
+	BytesTotal   int64 `json:"bytesTotal"`
+	PacketsTotal int64 `json:"packetsTotal"`
+	Drops        int64 `json:"drops"`
+}
+
+// captureWorker is one goroutine streaming pcap data for a single app index.
+// Its context can be cancelled independently of the other workers in the
+// session, which is what makes indices addable/removable mid-stream.
+type captureWorker struct {
+	index  int
+	cancel context.CancelFunc
+}
+
+// captureSession owns the goroutine fan-in for one logical capture request,
+// whether it was started via the chunked-HTTP /capture endpoint or the
+// /capture/ws streaming endpoint. It replaces the former bare "one goroutine
+// per index, one shared channel" pattern in handleCapture with addressable
+// workers so a controller (the websocket handler) can pause, resume, change
+// the filter, or add/remove indices while the capture is in flight.
+type captureSession struct {
+	id        string
+	server    *Server
+	appId     string
+	appType   string
+	device    string
+	authToken string
+	tokenHash string
+	startTime time.Time
+
+	mu      sync.Mutex
+	filter  string
+	paused  int32
+	workers map[int]*captureWorker
+	stats   map[int]*indexStats
+
+	packets chan packetMessage
+
+	// done is closed exactly once, by stop(), so that a consumer selecting
+	// on both cs.packets and cs.done (handleCaptureWS) notices a "stop"
+	// control message or a read error even though cs.packets itself is
+	// never closed (workers keep sending their own end-of-stream markers
+	// on it independently of stop()).
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newCaptureSession(s *Server, id, appId, appType, device, filter, authToken string) *captureSession {
+	return &captureSession{
+		id:        id,
+		server:    s,
+		appId:     appId,
+		appType:   appType,
+		device:    device,
+		filter:    filter,
+		authToken: authToken,
+		tokenHash: cfclient.TokenHash(authToken),
+		startTime: time.Now(),
+		workers:   make(map[int]*captureWorker),
+		stats:     make(map[int]*indexStats),
+		packets:   make(chan packetMessage, 1000),
+		done:      make(chan struct{}),
+	}
+}
+
+// captureSummary is the JSON-friendly snapshot of a session exposed via the
+// /captures endpoint.
+type captureSummary struct {
+	ID         string    `json:"id"`
+	AppGUID    string    `json:"appGuid"`
+	Indices    []int     `json:"indices"`
+	StartTime  time.Time `json:"startTime"`
+	BytesTotal int64     `json:"bytesTotal"`
+}
+
+func (cs *captureSession) summary() captureSummary {
+	bytesTotal := int64(0)
+	for _, stats := range cs.statsSnapshot() {
+		bytesTotal += stats.BytesTotal
+	}
+
+	return captureSummary{
+		ID:         cs.id,
+		AppGUID:    cs.appId,
+		Indices:    cs.indices(),
+		StartTime:  cs.startTime,
+		BytesTotal: bytesTotal,
+	}
+}
+
+// indices returns the app indices currently being captured.
+func (cs *captureSession) indices() []int {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	indices := make([]int, 0, len(cs.workers))
+	for index := range cs.workers {
+		indices = append(indices, index)
+	}
+	return indices
+}
+
+// setFilter updates the BPF filter used for indices added from now on.
+// Workers already running keep capturing with the filter they started
+// with until they are removed and re-added.
+func (cs *captureSession) setFilter(filter string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.filter = filter
+}
+
+func (cs *captureSession) pause() {
+	atomic.StoreInt32(&cs.paused, 1)
+}
+
+func (cs *captureSession) resume() {
+	atomic.StoreInt32(&cs.paused, 0)
+}
+
+func (cs *captureSession) isPaused() bool {
+	return atomic.LoadInt32(&cs.paused) == 1
+}
+
+// addIndex starts a new per-index worker with its own cancelable context and
+// wires its output into the session's shared packet channel.
+func (cs *captureSession) addIndex(index int) {
+	cs.mu.Lock()
+	if _, exists := cs.workers[index]; exists {
+		cs.mu.Unlock()
+		return
+	}
+	filter := cs.filter
+	ctx, cancel := context.WithCancel(context.Background())
+	cs.workers[index] = &captureWorker{index: index, cancel: cancel}
+	cs.stats[index] = &indexStats{}
+	cs.mu.Unlock()
+
+	go cs.runWorker(ctx, index, filter)
+}
+
+// removeIndex cancels the worker for the given index, if any. The worker
+// itself delivers the final packetMessage{done: true} when its context is
+// cancelled, so the merge loop notices the index going away.
+func (cs *captureSession) removeIndex(index int) {
+	cs.mu.Lock()
+	worker, exists := cs.workers[index]
+	if exists {
+		delete(cs.workers, index)
+		delete(cs.stats, index)
+	}
+	cs.mu.Unlock()
+	if exists {
+		worker.cancel()
+	}
+}
+
+// stop cancels every worker in the session and signals cs.done, so a
+// handler blocked in a select on cs.done (e.g. handleCaptureWS) wakes up
+// and returns instead of looping forever once the session is done
+// producing capture data. It is safe to call more than once, and from more
+// than one goroutine at a time (the websocket read loop and the handler's
+// own deferred cleanup can both call it for the same session).
+func (cs *captureSession) stop() {
+	cs.mu.Lock()
+	workers := make([]*captureWorker, 0, len(cs.workers))
+	for _, worker := range cs.workers {
+		workers = append(workers, worker)
+	}
+	cs.workers = make(map[int]*captureWorker)
+	cs.mu.Unlock()
+	for _, worker := range workers {
+		worker.cancel()
+	}
+	cs.closeOnce.Do(func() {
+		close(cs.done)
+	})
+}
+
+// awaitFirstPacket blocks until the session's first real packet arrives, or
+// every one of the expected workers has sent its end-of-stream marker
+// without ever producing one (e.g. because the upstream pcap-server was
+// unreachable for every index). It exists so a caller that has not written
+// a response status yet (the single-shot /capture handlers, unlike
+// /capture/ws which is already committed to a 101 by the time any of this
+// runs) can tell a total failure from a merely empty capture and report it
+// instead of silently returning an empty 200 OK.
+//
+// doneSoFar is how many of the expected end-of-stream markers were already
+// consumed while waiting, so a caller resuming its own "range cs.packets"
+// loop after a successful wait can start counting from there instead of
+// losing track of workers that finished before the first packet arrived.
+func (cs *captureSession) awaitFirstPacket(expected int) (first packetMessage, ok bool, doneSoFar int, firstErr error) {
+	for msg := range cs.packets {
+		if msg.packet != nil {
+			return msg, true, doneSoFar, firstErr
+		}
+		if msg.err != nil && firstErr == nil {
+			firstErr = msg.err
+		}
+		doneSoFar++
+		if doneSoFar == expected {
+			return packetMessage{}, false, doneSoFar, firstErr
+		}
+	}
+	return packetMessage{}, false, doneSoFar, firstErr
+}
+
+// statsSnapshot returns a copy of the per-index stats safe to marshal
+// without holding the session lock while writing to a client.
+func (cs *captureSession) statsSnapshot() map[int]indexStats {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	snapshot := make(map[int]indexStats, len(cs.stats))
+	for index, stats := range cs.stats {
+		snapshot[index] = indexStats{
+			BytesTotal:   atomic.LoadInt64(&stats.BytesTotal),
+			PacketsTotal: atomic.LoadInt64(&stats.PacketsTotal),
+			Drops:        atomic.LoadInt64(&stats.Drops),
+		}
+	}
+	return snapshot
+}
+
+// runWorker streams pcap data for a single app index until ctx is cancelled
+// or the upstream pcap-server closes the stream. It is the addressable
+// equivalent of the inline goroutine handleCapture used to start for every
+// index before this session type existed.
+func (cs *captureSession) runWorker(ctx context.Context, index int, filter string) {
+	var workerErr error
+	defer func() {
+		cs.packets <- packetMessage{index: index, done: true, err: workerErr}
+	}()
+
+	appLocation, err := cs.server.getAppLocation(ctx, cs.appId, index, cs.appType, cs.authToken)
+	if err != nil {
+		log.Errorf("could not get location of app %s index %d of type %s (%s)", cs.appId, index, cs.appType, err)
+		streamErrorsTotal.Inc()
+		workerErr = err
+		return
+	}
+
+	pcapServerURL := fmt.Sprintf("https://%s:%s/capture?appid=%s&index=%d&device=%s&filter=%s",
+		appLocation, cs.server.config.PcapServerPort, cs.appId, index, cs.device, filter)
+	pcapStream, err := cs.server.getPcapStream(ctx, pcapServerURL)
+	if err != nil {
+		log.Errorf("could not get pcap stream from URL %s (%s)", pcapServerURL, err)
+		streamErrorsTotal.Inc()
+		workerErr = err
+		return
+	}
+	defer pcapStream.Close()
+
+	pcapReader, err := pcapgo.NewReader(pcapStream)
+	if err != nil {
+		log.Errorf("could not create pcap reader from pcap stream %s (%s)", pcapStream, err)
+		streamErrorsTotal.Inc()
+		workerErr = err
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		data, capInfo, err := pcapReader.ReadPacketData()
+		if err != nil {
+			if err == io.EOF {
+				log.Debug("Done capturing.")
+			} else {
+				log.Errorf("Error during capture: %s", err)
+				streamErrorsTotal.Inc()
+				workerErr = err
+			}
+			return
+		}
+
+		if cs.isPaused() {
+			cs.bumpDrops(index)
+			continue
+		}
+
+		packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+		packet.Metadata().CaptureInfo = capInfo
+
+		select {
+		case cs.packets <- packetMessage{packet: packet, index: index}:
+			cs.bumpStats(index, capInfo.Length)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (cs *captureSession) bumpStats(index int, length int) {
+	cs.mu.Lock()
+	stats, exists := cs.stats[index]
+	cs.mu.Unlock()
+	if !exists {
+		return
+	}
+	atomic.AddInt64(&stats.BytesTotal, int64(length))
+	atomic.AddInt64(&stats.PacketsTotal, 1)
+	bytesStreamedTotal.Add(float64(length))
+}
+
+func (cs *captureSession) bumpDrops(index int) {
+	cs.mu.Lock()
+	stats, exists := cs.stats[index]
+	cs.mu.Unlock()
+	if !exists {
+		return
+	}
+	atomic.AddInt64(&stats.Drops, 1)
+}
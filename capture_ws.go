@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/domdom82/pcap-server-api/cfclient"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+var wsUpgrader = websocket.Upgrader{
+	// The API is consumed by CF CLI plugins and browser-based dashboards
+	// alike, neither of which share an origin with this server.
+	CheckOrigin: func(request *http.Request) bool { return true },
+}
+
+const wsStatsInterval = 2 * time.Second
+
+// wsControlMessage is sent by the client over the websocket to steer an
+// in-progress capture: pause/resume it, change its BPF filter, or add/remove
+// an app index without tearing down the connection.
+type wsControlMessage struct {
+	Action string `json:"action"` // "pause", "resume", "filter", "add_index", "remove_index", "stop"
+	Filter string `json:"filter,omitempty"`
+	Index  int    `json:"index,omitempty"`
+}
+
+// wsStatsMessage is sent by the server every wsStatsInterval to
+// report per-index byte/packet/drop counters so a client can show
+// backpressure-aware progress without parsing the pcap stream itself.
+type wsStatsMessage struct {
+	Type     string             `json:"type"`
+	PerIndex map[int]indexStats `json:"perIndex"`
+}
+
+// handleCaptureWS upgrades the request to a websocket and streams merged
+// pcap frames to the client, interleaved with JSON stats frames. Unlike
+// /capture, the set of indices and the BPF filter can be changed mid-stream
+// via control messages sent by the client.
+func (s *Server) handleCaptureWS(response http.ResponseWriter, request *http.Request) {
+	appId := request.URL.Query().Get("appid")
+	appIndicesStr := request.URL.Query()["index"]
+	appType := request.URL.Query().Get("type")
+	device := request.URL.Query().Get("device")
+	filter := request.URL.Query().Get("filter")
+	authToken := request.Header.Get("Authorization")
+
+	if appId == "" {
+		response.WriteHeader(http.StatusBadRequest)
+		response.Write([]byte("appid missing"))
+		return
+	}
+	identity, hasIdentity := identityFromContext(request.Context())
+
+	if authToken == "" && !hasIdentity {
+		response.WriteHeader(http.StatusUnauthorized)
+		response.Write([]byte("authentication required"))
+		return
+	}
+	if appType == "" {
+		appType = "web"
+	}
+	if device == "" {
+		device = "eth0"
+	}
+
+	var appIndices []int
+	for _, appIndexStr := range appIndicesStr {
+		appIndex, err := strconv.Atoi(appIndexStr)
+		if err != nil {
+			response.WriteHeader(http.StatusBadRequest)
+			response.Write([]byte("could not parse index parameter"))
+			return
+		}
+		appIndices = append(appIndices, appIndex)
+	}
+	if len(appIndices) == 0 {
+		appIndices = append(appIndices, 0)
+	}
+
+	var appVisible bool
+	var err error
+	if hasIdentity && identity.CanSeeApp(appId) {
+		log.Debugf("app %s authorized via mTLS identity %s", appId, identity.CommonName)
+		appVisible = true
+	} else {
+		appVisible, err = s.isAppVisibleByToken(appId, authToken)
+		if err != nil {
+			log.Errorf("could not check if app %s can be seen by token %s (%s)", appId, authToken, err)
+			response.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	if !appVisible {
+		log.Infof("app %s cannot be seen by token %s", appId, authToken)
+		response.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	limiterKey := cfclient.TokenHash(authToken)
+	if authToken == "" && hasIdentity {
+		limiterKey = "mtls:" + identity.CommonName
+	}
+	if !s.limiter.acquire(limiterKey) {
+		response.Header().Set("Retry-After", "5")
+		response.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+	defer s.limiter.release(limiterKey)
+
+	conn, err := wsUpgrader.Upgrade(response, request, nil)
+	if err != nil {
+		log.Errorf("could not upgrade connection to websocket: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	cs := newCaptureSession(s, newCaptureID(), appId, appType, device, filter, authToken)
+	s.registerSession(cs)
+	defer s.unregisterSession(cs)
+	for _, index := range appIndices {
+		cs.addIndex(index)
+	}
+	defer cs.stop()
+
+	go s.readCaptureWSControl(conn, cs)
+
+	pcapWriter := newWSPcapWriter(conn)
+	w := pcapgo.NewWriter(pcapWriter)
+	if err := w.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+		log.Errorf("could not write pcap file header: %s", err)
+		return
+	}
+
+	statsTicker := time.NewTicker(wsStatsInterval)
+	defer statsTicker.Stop()
+
+	for {
+		select {
+		case msg, ok := <-cs.packets:
+			if !ok {
+				return
+			}
+			if msg.packet == nil {
+				continue
+			}
+			if err := w.WritePacket(msg.packet.Metadata().CaptureInfo, msg.packet.Data()); err != nil {
+				log.Errorf("could not write packet to websocket: %s", err)
+				return
+			}
+		case <-statsTicker.C:
+			if err := s.writeCaptureWSStats(conn, cs); err != nil {
+				log.Errorf("could not write stats frame: %s", err)
+				return
+			}
+		case <-cs.done:
+			// A "stop" control message or a read error on the control
+			// connection ended the session; nothing more will arrive on
+			// cs.packets that we care about, so stop ticking stats and let
+			// the deferred conn.Close()/s.limiter.release() above run.
+			return
+		}
+	}
+}
+
+// readCaptureWSControl reads JSON control messages from the client for the
+// lifetime of the connection and applies them to the capture session.
+func (s *Server) readCaptureWSControl(conn *websocket.Conn, cs *captureSession) {
+	for {
+		var ctrl wsControlMessage
+		if err := conn.ReadJSON(&ctrl); err != nil {
+			cs.stop()
+			return
+		}
+		switch ctrl.Action {
+		case "pause":
+			cs.pause()
+		case "resume":
+			cs.resume()
+		case "filter":
+			cs.setFilter(ctrl.Filter)
+		case "add_index":
+			cs.addIndex(ctrl.Index)
+		case "remove_index":
+			cs.removeIndex(ctrl.Index)
+		case "stop":
+			cs.stop()
+			return
+		default:
+			log.Warnf("unknown websocket control action %q", ctrl.Action)
+		}
+	}
+}
+
+func (s *Server) writeCaptureWSStats(conn *websocket.Conn, cs *captureSession) error {
+	msg := wsStatsMessage{
+		Type:     "stats",
+		PerIndex: cs.statsSnapshot(),
+	}
+	return conn.WriteJSON(msg)
+}
+
+// handleStats exposes the stats of all currently active capture sessions
+// (both /capture and /capture/ws) for operators, independent of any one
+// client's own in-band stats frames. It requires a CF token that is
+// currently active, the same bar /captures holds itself to, since both
+// endpoints expose the same kind of session-level operational detail.
+func (s *Server) handleStats(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		response.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	authToken := request.Header.Get("Authorization")
+	if authToken == "" {
+		response.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	info, err := s.cf.IntrospectToken(context.Background(), authToken)
+	if err != nil {
+		log.Errorf("could not introspect token for /stats request: %s", err)
+		response.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !info.Active {
+		response.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	s.sessionsMu.Lock()
+	sessions := make(map[string]map[int]indexStats, len(s.sessions))
+	for id, cs := range s.sessions {
+		sessions[id] = cs.statsSnapshot()
+	}
+	s.sessionsMu.Unlock()
+
+	response.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(response).Encode(sessions); err != nil {
+		log.Errorf("could not encode stats response: %s", err)
+		response.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// wsPcapWriter adapts a websocket connection to io.Writer so pcapgo.Writer
+// can write each chunk as its own binary websocket message, giving the
+// transport natural backpressure (gorilla's WriteMessage blocks when the
+// client isn't reading fast enough).
+type wsPcapWriter struct {
+	conn *websocket.Conn
+}
+
+func newWSPcapWriter(conn *websocket.Conn) *wsPcapWriter {
+	return &wsPcapWriter{conn: conn}
+}
+
+func (w *wsPcapWriter) Write(p []byte) (int, error) {
+	if err := w.conn.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/domdom82/pcap-server-api/config"
+	"github.com/domdom82/pcap-server-api/test"
+	"github.com/gorilla/websocket"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Streaming Capture Tests", func() {
+	var server *Server
+	var err error
+	pcapResponses := map[string]string{
+		"/capture?appid=1234&index=0&device=eth0&filter=": "test/sample-1.pcap",
+	}
+	pcapServer := test.NewMockPcapServer(pcapResponses)
+	responses := map[string]string{
+		"/v3/apps/1234": "{\n\"guid\": \"1234\",\n  \"name\": \"my-app\",\n  \"state\": \"STARTED\" \n}",
+		"/v3/apps/1234/processes/web/stats": fmt.Sprintf("{\n\"resources\": [\n {\n \"type\": \"web\",\n \"index\": 0,"+
+			"\n \"state\": \"RUNNING\","+
+			"\n \"host\": \"%s\"\n}]}", pcapServer.Host),
+		"/uaa/introspect": "{\"active\": true}",
+	}
+	cfAPI := test.MockCfAPI(responses)
+	cfg := config.DefaultConfig
+	cfg.CfAPI = cfAPI.URL
+	cfg.PcapServerPort = pcapServer.Port
+
+	BeforeEach(func() {
+		server, err = NewServer(&cfg)
+		Expect(err).To(BeNil())
+		go server.Run()
+		time.Sleep(100 * time.Millisecond)
+	})
+	AfterEach(func() {
+		server.Stop()
+	})
+
+	Context("Connecting to the websocket capture endpoint", func() {
+		It("Accepts the upgrade and streams at least one pcap frame", func() {
+			wsURL := "ws://localhost:8080/capture/ws?appid=1234&index=0"
+			header := http.Header{"Authorization": {"myToken"}}
+			conn, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+			Expect(err).To(BeNil())
+			defer conn.Close()
+
+			_, data, err := conn.ReadMessage()
+			Expect(err).To(BeNil())
+			Expect(len(data)).To(BeNumerically(">", 0))
+		})
+		It("Rejects requests without an app id", func() {
+			wsURL := "ws://localhost:8080/capture/ws"
+			header := http.Header{"Authorization": {"myToken"}}
+			_, res, err := websocket.DefaultDialer.Dial(wsURL, header)
+			Expect(err).NotTo(BeNil())
+			Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+		})
+	})
+
+	Context("Querying the /stats endpoint", func() {
+		It("Reports active capture sessions while a capture is in flight", func() {
+			wsURL := "ws://localhost:8080/capture/ws?appid=1234&index=0"
+			header := http.Header{"Authorization": {"myToken"}}
+			conn, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+			Expect(err).To(BeNil())
+			defer conn.Close()
+
+			req, _ := http.NewRequest(http.MethodGet, "http://localhost:8080/stats", strings.NewReader(""))
+			req.Header.Set("Authorization", "myToken")
+			r, err := http.DefaultClient.Do(req)
+			Expect(err).To(BeNil())
+			Expect(r.StatusCode).To(Equal(http.StatusOK))
+			Expect(r.Header.Get("Content-Type")).To(Equal("application/json"))
+			var sessions map[string]map[int]indexStats
+			Expect(json.NewDecoder(r.Body).Decode(&sessions)).To(Succeed())
+			Expect(sessions).To(HaveLen(1))
+		})
+		It("Rejects requests without a CF token, like /captures does", func() {
+			r, err := http.Get("http://localhost:8080/stats")
+			Expect(err).To(BeNil())
+			Expect(r.StatusCode).To(Equal(http.StatusUnauthorized))
+		})
+		It("Rejects non-GET requests", func() {
+			req, _ := http.NewRequest(http.MethodDelete, "http://localhost:8080/stats", strings.NewReader(""))
+			req.Header.Set("Authorization", "myToken")
+			res, err := http.DefaultClient.Do(req)
+			Expect(err).To(BeNil())
+			Expect(res.StatusCode).To(Equal(http.StatusMethodNotAllowed))
+		})
+	})
+
+	Context("Sending control messages over the websocket", func() {
+		findSession := func() *captureSession {
+			server.sessionsMu.Lock()
+			defer server.sessionsMu.Unlock()
+			for _, cs := range server.sessions {
+				return cs
+			}
+			return nil
+		}
+
+		It("pauses, resumes, changes the filter, removes the index and stops the session", func() {
+			wsURL := "ws://localhost:8080/capture/ws?appid=1234&index=0"
+			header := http.Header{"Authorization": {"myToken"}}
+			conn, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+			Expect(err).To(BeNil())
+			defer conn.Close()
+
+			var cs *captureSession
+			Eventually(func() *captureSession {
+				cs = findSession()
+				return cs
+			}).ShouldNot(BeNil())
+
+			Expect(conn.WriteJSON(wsControlMessage{Action: "pause"})).To(BeNil())
+			Eventually(cs.isPaused).Should(BeTrue())
+
+			Expect(conn.WriteJSON(wsControlMessage{Action: "resume"})).To(BeNil())
+			Eventually(cs.isPaused).Should(BeFalse())
+
+			Expect(conn.WriteJSON(wsControlMessage{Action: "filter", Filter: "tcp port 80"})).To(BeNil())
+			Eventually(func() string {
+				cs.mu.Lock()
+				defer cs.mu.Unlock()
+				return cs.filter
+			}).Should(Equal("tcp port 80"))
+
+			Expect(conn.WriteJSON(wsControlMessage{Action: "remove_index", Index: 0})).To(BeNil())
+			Eventually(cs.indices).Should(BeEmpty())
+
+			Expect(conn.WriteJSON(wsControlMessage{Action: "stop"})).To(BeNil())
+
+			// A stopped session must make the handler return (closing the
+			// limiter slot and the connection), not leave it looping
+			// forever ticking stats frames at a client that stopped
+			// capturing.
+			conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+			var closeErr error
+			for i := 0; i < 10; i++ {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					closeErr = err
+					break
+				}
+			}
+			Expect(closeErr).NotTo(BeNil())
+			Eventually(findSession).Should(BeNil())
+		})
+	})
+})
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// handleCaptures lists every currently active capture session (started via
+// either /capture or /capture/ws), for operators. It requires a CF token
+// that is currently active, but does not check that the token can see any
+// particular app: it is meant for debugging/operating the service itself.
+func (s *Server) handleCaptures(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		response.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	authToken := request.Header.Get("Authorization")
+	if authToken == "" {
+		response.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	info, err := s.cf.IntrospectToken(context.Background(), authToken)
+	if err != nil {
+		log.Errorf("could not introspect token for /captures request: %s", err)
+		response.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !info.Active {
+		response.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	s.sessionsMu.Lock()
+	summaries := make([]captureSummary, 0, len(s.sessions))
+	for _, cs := range s.sessions {
+		summaries = append(summaries, cs.summary())
+	}
+	s.sessionsMu.Unlock()
+
+	response.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(response).Encode(summaries); err != nil {
+		log.Errorf("could not encode captures response: %s", err)
+		response.WriteHeader(http.StatusInternalServerError)
+	}
+}
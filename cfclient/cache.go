@@ -0,0 +1,100 @@
+package cfclient
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// ttlCache is a small LRU cache with per-entry expiry. A capacity of zero
+// (or less) disables caching: get always misses and set is a no-op.
+type ttlCache struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+type ttlCacheEntry struct {
+	key       string
+	value     interface{}
+	expiresAt time.Time
+}
+
+func newTTLCache(capacity int, ttl time.Duration) *ttlCache {
+	return &ttlCache{
+		capacity: capacity,
+		ttl:      ttl,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func (c *ttlCache) get(key string) (interface{}, bool) {
+	if c.capacity <= 0 {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*ttlCacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+
+	c.order.MoveToFront(elem)
+
+	return entry.value, true
+}
+
+func (c *ttlCache) set(key string, value interface{}) {
+	if c.capacity <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*ttlCacheEntry)
+		entry.value = value
+		entry.expiresAt = time.Now().Add(c.ttl)
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	elem := c.order.PushFront(&ttlCacheEntry{
+		key:       key,
+		value:     value,
+		expiresAt: time.Now().Add(c.ttl),
+	})
+	c.entries[key] = elem
+
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		if oldest == nil {
+			break
+		}
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*ttlCacheEntry).key)
+	}
+}
+
+// TokenHash returns a non-reversible fingerprint of a bearer token, suitable
+// for use as (part of) a cache key, rate-limiter key, or registry key
+// without keeping the raw token in memory any longer than the request that
+// presented it.
+func TokenHash(authToken string) string {
+	sum := sha256.Sum256([]byte(authToken))
+	return hex.EncodeToString(sum[:])
+}
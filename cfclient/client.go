@@ -0,0 +1,313 @@
+// Package cfclient provides a single point of access to the Cloud Controller
+// and UAA APIs pcap-server-api needs: looking up an app, finding out where
+// its instances run, and checking whether a token is allowed to see it.
+//
+// It exists to remove the duplication between the old Server.isAppVisibleByToken
+// and Server.getAppLocation methods, which both repeated the same "discover
+// CC, build a request, attach the token, decode the response" dance. On top
+// of de-duplicating that, it adds a short-TTL cache for the lookups
+// /capture tends to repeat for the same app, and retries transient CC/UAA
+// errors instead of failing a whole capture request over one 503.
+package cfclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// App is the subset of the CC v3 app resource pcap-server-api cares about.
+type App struct {
+	GUID string `json:"guid"`
+	Name string `json:"name"`
+}
+
+// ProcessStats is one entry of the CC v3 process stats resource, i.e. one
+// running instance of an app.
+type ProcessStats struct {
+	Type  string `json:"type"`
+	Index int    `json:"index"`
+	Host  string `json:"host"`
+}
+
+// TokenInfo is the result of introspecting a bearer token at UAA.
+type TokenInfo struct {
+	Active   bool     `json:"active"`
+	UserID   string   `json:"user_id"`
+	ClientID string   `json:"client_id"`
+	Scope    []string `json:"scope"`
+}
+
+type cfAPIResponse struct {
+	Links struct {
+		CCv3 struct {
+			Href string `json:"href"`
+		} `json:"cloud_controller_v3"`
+		UAA struct {
+			Href string `json:"href"`
+		} `json:"uaa"`
+	} `json:"links"`
+}
+
+// Options configures a Client's caching, retry, and transport behavior.
+type Options struct {
+	// CacheSize is the maximum number of entries kept per cache (app
+	// visibility, process stats). Zero disables caching.
+	CacheSize int
+	// CacheTTL is how long a cached entry is considered fresh.
+	CacheTTL time.Duration
+	// MaxRetries is how many additional attempts are made after a request
+	// fails with a transient network error or a 5xx response.
+	MaxRetries int
+	// RetryBackoff is the base delay before the first retry; it doubles
+	// on each subsequent attempt.
+	RetryBackoff time.Duration
+	// Transport is used for all outbound HTTP requests. Defaults to
+	// http.DefaultTransport; tests can inject a fake RoundTripper here
+	// instead of spinning up test.MockCfAPI.
+	Transport http.RoundTripper
+}
+
+// DefaultOptions returns the Options pcap-server-api uses in production.
+func DefaultOptions() Options {
+	return Options{
+		CacheSize:    256,
+		CacheTTL:     30 * time.Second,
+		MaxRetries:   3,
+		RetryBackoff: 200 * time.Millisecond,
+	}
+}
+
+// Client is the CF API client used by Server. It is safe for concurrent use.
+type Client struct {
+	httpClient *http.Client
+	opts       Options
+
+	ccBaseURL  string
+	uaaBaseURL string
+
+	visibilityCache *ttlCache
+	statsCache      *ttlCache
+}
+
+// New discovers the CC/UAA endpoints behind cfAPI and returns a ready-to-use
+// Client. This replaces the discovery logic that used to live in
+// Server.setup.
+func New(ctx context.Context, cfAPI string, opts Options) (*Client, error) {
+	transport := opts.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	c := &Client{
+		httpClient:      &http.Client{Transport: transport},
+		opts:            opts,
+		visibilityCache: newTTLCache(opts.CacheSize, opts.CacheTTL),
+		statsCache:      newTTLCache(opts.CacheSize, opts.CacheTTL),
+	}
+
+	log.Info("Discovering CF API endpoints...")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cfAPI, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch CF API from %s (%w)", cfAPI, err)
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not read CF API response: %w", err)
+	}
+	var apiResponse cfAPIResponse
+	if err := json.Unmarshal(data, &apiResponse); err != nil {
+		return nil, fmt.Errorf("could not parse CF API response: %w", err)
+	}
+
+	c.ccBaseURL = apiResponse.Links.CCv3.Href
+	c.uaaBaseURL = apiResponse.Links.UAA.Href
+	log.Info("Done.")
+
+	return c, nil
+}
+
+// CCBaseURL returns the discovered Cloud Controller v3 base URL.
+func (c *Client) CCBaseURL() string { return c.ccBaseURL }
+
+// UAABaseURL returns the discovered UAA base URL.
+func (c *Client) UAABaseURL() string { return c.uaaBaseURL }
+
+// GetApp fetches an app's CC metadata.
+func (c *Client) GetApp(ctx context.Context, appId string, authToken string) (*App, error) {
+	appURL, err := url.Parse(fmt.Sprintf("%s/apps/%s", c.ccBaseURL, appId))
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, appURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", authToken)
+
+	res, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("expected status code %d but got status code %d", http.StatusOK, res.StatusCode)
+	}
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	var app App
+	if err := json.Unmarshal(data, &app); err != nil {
+		return nil, err
+	}
+
+	return &app, nil
+}
+
+// GetProcessStats fetches the running instances of an app's process, cached
+// for opts.CacheTTL keyed by (appId, processType) since /capture tends to
+// look up the same app's instances repeatedly.
+func (c *Client) GetProcessStats(ctx context.Context, appId string, processType string, authToken string) ([]ProcessStats, error) {
+	cacheKey := appId + "|" + processType
+	if cached, ok := c.statsCache.get(cacheKey); ok {
+		return cached.([]ProcessStats), nil
+	}
+
+	statsURL, err := url.Parse(fmt.Sprintf("%s/apps/%s/processes/%s/stats", c.ccBaseURL, appId, processType))
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, statsURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", authToken)
+
+	res, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("expected status code %d but got status code %d", http.StatusOK, res.StatusCode)
+	}
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	var statsResponse struct {
+		Resources []ProcessStats `json:"resources"`
+	}
+	if err := json.Unmarshal(data, &statsResponse); err != nil {
+		return nil, err
+	}
+
+	c.statsCache.set(cacheKey, statsResponse.Resources)
+
+	return statsResponse.Resources, nil
+}
+
+// CanUserSeeApp reports whether the given token can see the given app,
+// cached for opts.CacheTTL keyed by (token-hash, appId).
+func (c *Client) CanUserSeeApp(ctx context.Context, appId string, authToken string) (bool, error) {
+	cacheKey := TokenHash(authToken) + "|" + appId
+	if cached, ok := c.visibilityCache.get(cacheKey); ok {
+		return cached.(bool), nil
+	}
+
+	app, err := c.GetApp(ctx, appId, authToken)
+	if err != nil {
+		return false, err
+	}
+	if app.GUID != appId {
+		return false, fmt.Errorf("expected app id %s but got app id %s (%s)", appId, app.GUID, app.Name)
+	}
+
+	c.visibilityCache.set(cacheKey, true)
+
+	return true, nil
+}
+
+// IntrospectToken asks UAA whether authToken is currently active and what
+// it is scoped to.
+func (c *Client) IntrospectToken(ctx context.Context, authToken string) (*TokenInfo, error) {
+	introspectURL := fmt.Sprintf("%s/introspect", c.uaaBaseURL)
+	form := url.Values{"token": {authToken}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, introspectURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", authToken)
+
+	res, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("expected status code %d but got status code %d", http.StatusOK, res.StatusCode)
+	}
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	var info TokenInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
+
+// do executes req, retrying on transient network errors and 5xx responses
+// with exponential backoff. It gives up once ctx is done or the retry
+// budget is exhausted.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	var lastErr error
+
+	for attempt := 0; attempt <= c.opts.MaxRetries; attempt++ {
+		if attempt > 0 {
+			backoff := c.opts.RetryBackoff * time.Duration(1<<uint(attempt-1))
+			select {
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			case <-time.After(backoff):
+			}
+		}
+
+		res, err := c.httpClient.Do(req)
+		if err != nil {
+			lastErr = err
+			log.Warnf("CF API request to %s failed (attempt %d/%d): %s", req.URL, attempt+1, c.opts.MaxRetries+1, err)
+			continue
+		}
+		if res.StatusCode >= http.StatusInternalServerError {
+			lastErr = fmt.Errorf("CF API returned status %d", res.StatusCode)
+			res.Body.Close()
+			log.Warnf("CF API request to %s got status %d (attempt %d/%d)", req.URL, res.StatusCode, attempt+1, c.opts.MaxRetries+1)
+			continue
+		}
+
+		return res, nil
+	}
+
+	return nil, lastErr
+}
@@ -0,0 +1,99 @@
+package cfclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T) (*httptest.Server, *int32) {
+	t.Helper()
+	var appRequests int32
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"links": map[string]interface{}{
+				"cloud_controller_v3": map[string]string{"href": ""},
+				"uaa":                 map[string]string{"href": ""},
+			},
+		})
+	})
+	mux.HandleFunc("/apps/1234", func(w http.ResponseWriter, r *http.Request) {
+		appRequests++
+		_ = json.NewEncoder(w).Encode(App{GUID: "1234", Name: "my-app"})
+	})
+
+	srv := httptest.NewServer(mux)
+	return srv, &appRequests
+}
+
+func TestCanUserSeeAppCachesResult(t *testing.T) {
+	srv, appRequests := newTestServer(t)
+	defer srv.Close()
+
+	ctx := context.Background()
+	c, err := New(ctx, srv.URL, Options{CacheSize: 10, CacheTTL: time.Minute, MaxRetries: 0})
+	if err != nil {
+		t.Fatalf("New() failed: %s", err)
+	}
+	c.ccBaseURL = srv.URL
+
+	for i := 0; i < 3; i++ {
+		visible, err := c.CanUserSeeApp(ctx, "1234", "mytoken")
+		if err != nil {
+			t.Fatalf("CanUserSeeApp() failed: %s", err)
+		}
+		if !visible {
+			t.Fatalf("expected app to be visible")
+		}
+	}
+
+	if *appRequests != 1 {
+		t.Fatalf("expected 1 CC request due to caching, got %d", *appRequests)
+	}
+}
+
+func TestDoRetriesOn5xx(t *testing.T) {
+	var attempts int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"links": map[string]interface{}{
+				"cloud_controller_v3": map[string]string{"href": ""},
+				"uaa":                 map[string]string{"href": ""},
+			},
+		})
+	})
+	mux.HandleFunc("/apps/1234", func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(App{GUID: "1234", Name: "my-app"})
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	ctx := context.Background()
+	c, err := New(ctx, srv.URL, Options{MaxRetries: 3, RetryBackoff: time.Millisecond})
+	if err != nil {
+		t.Fatalf("New() failed: %s", err)
+	}
+	c.ccBaseURL = srv.URL
+
+	app, err := c.GetApp(ctx, "1234", "mytoken")
+	if err != nil {
+		t.Fatalf("GetApp() failed: %s", err)
+	}
+	if app.GUID != "1234" {
+		t.Fatalf("expected guid 1234, got %s", app.GUID)
+	}
+	if attempts != 3 {
+		t.Fatalf("expected 3 attempts, got %d", attempts)
+	}
+}
@@ -0,0 +1,63 @@
+// Package config holds the runtime configuration for pcap-server-api.
+package config
+
+// Config holds everything Server needs to start listening and to talk to
+// CF and the per-cell pcap-server instances.
+type Config struct {
+	// CfAPI is the root CF API URL used to discover the CC/UAA endpoints.
+	CfAPI string
+
+	// Listen is the TCP address the API server listens on, e.g. ":8080".
+	Listen string
+
+	// ListenSocket is an optional path to a Unix domain socket the API
+	// server additionally (or instead) listens on. Empty disables it.
+	ListenSocket string
+	// SocketMode is the file mode applied to ListenSocket after it is
+	// created, e.g. 0660. Ignored if ListenSocket is empty.
+	SocketMode string
+	// SocketOwner is an optional "user:group" applied to ListenSocket
+	// after it is created. Ignored if ListenSocket is empty or SocketOwner
+	// is empty.
+	SocketOwner string
+
+	EnableServerTLS bool
+	Cert            string
+	Key             string
+
+	CLIDownloadRoot string
+
+	PcapServerPort             string
+	PcapServerName             string
+	PcapServerClientCert       string
+	PcapServerClientKey        string
+	PcapServerCaCert           string
+	PcapServerClientSkipVerify bool
+
+	// MaxConcurrentCapturesPerToken caps how many captures a single CF
+	// token may have running at once. Zero means unlimited.
+	MaxConcurrentCapturesPerToken int
+	// MaxConcurrentCapturesGlobal caps how many captures the whole server
+	// will serve at once, across all tokens. Zero means unlimited.
+	MaxConcurrentCapturesGlobal int
+
+	// MTLSEnabled turns on additive TLS client certificate authentication
+	// at the API edge, authorized via MTLSPolicyFile. It has no effect
+	// unless EnableServerTLS is also set, since it configures the same
+	// *tls.Config the server listens with.
+	MTLSEnabled bool
+	// MTLSClientCACert is the PEM CA bundle used to verify client
+	// certificates presented during the TLS handshake.
+	MTLSClientCACert string
+	// MTLSPolicyFile is a YAML file mapping certificate CN/SAN patterns to
+	// the CF app GUIDs that certificate is allowed to capture.
+	MTLSPolicyFile string
+}
+
+// DefaultConfig is the configuration used when nothing overrides it, e.g. in
+// tests that only care about a subset of fields.
+var DefaultConfig = Config{
+	Listen:          ":8080",
+	CLIDownloadRoot: ".",
+	PcapServerPort:  "8443",
+}
@@ -0,0 +1,96 @@
+// Package mtls implements SAN/CN-based authorization for clients that
+// authenticate to pcap-server-api with a TLS client certificate instead of
+// (or in addition to) a CF token, e.g. automation that captures traffic
+// without a human CF session.
+package mtls
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Rule grants whatever presents a certificate matching Pattern (its
+// Subject Alternative Names, or its Common Name for legacy certs without
+// matching SANs) access to the listed CF app GUIDs.
+//
+// The policy file only ever matches on app GUIDs, not org/space GUIDs:
+// authorizing by org/space would mean resolving the app being captured up
+// through its space to its org on every request, which needs CC calls this
+// client doesn't make elsewhere in the capture path. Operators who want to
+// grant a whole org or space should list every app GUID in it explicitly
+// instead.
+type Rule struct {
+	Pattern         string   `yaml:"pattern"`
+	AllowedAppGUIDs []string `yaml:"allowedAppGuids"`
+}
+
+// Policy is the parsed form of the YAML policy file configured via
+// config.Config.MTLSPolicyFile.
+type Policy struct {
+	Rules []Rule `yaml:"rules"`
+}
+
+// LoadPolicy reads and parses a policy file from disk.
+func LoadPolicy(path string) (*Policy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var p Policy
+	if err := yaml.Unmarshal(data, &p); err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+// Identity is what a matched client certificate is allowed to do, handed to
+// the caller via the request context by the mTLS middleware.
+type Identity struct {
+	CommonName      string
+	SANs            []string
+	AllowedAppGUIDs []string
+}
+
+// CanSeeApp reports whether this identity's rule explicitly allows the
+// given app GUID.
+func (id *Identity) CanSeeApp(appGUID string) bool {
+	for _, guid := range id.AllowedAppGUIDs {
+		if guid == appGUID {
+			return true
+		}
+	}
+	return false
+}
+
+// Match finds the first rule whose pattern is asserted by cert and returns
+// the Identity it grants.
+func (p *Policy) Match(cert *x509.Certificate) (*Identity, bool) {
+	for _, rule := range p.Rules {
+		if certAssertsName(cert, rule.Pattern) {
+			return &Identity{
+				CommonName:      cert.Subject.CommonName,
+				SANs:            cert.DNSNames,
+				AllowedAppGUIDs: rule.AllowedAppGUIDs,
+			}, true
+		}
+	}
+
+	return nil, false
+}
+
+// certAssertsName reports whether cert is valid for name, either via its
+// SANs (the normal case) or, for legacy certs that never got a matching
+// SAN, via an exact Subject Common Name match. Go 1.15 stopped falling back
+// to the Common Name in x509.Certificate.VerifyHostname, which would
+// otherwise silently lock out certs issued before SANs were mandatory.
+func certAssertsName(cert *x509.Certificate, name string) bool {
+	if err := cert.VerifyHostname(name); err == nil {
+		return true
+	}
+
+	return cert.Subject.CommonName == name
+}
@@ -0,0 +1,81 @@
+package mtls
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func selfSignedCert(t *testing.T, commonName string, dnsNames []string) *x509.Certificate {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("could not generate key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("could not create certificate: %s", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("could not parse certificate: %s", err)
+	}
+
+	return cert
+}
+
+func TestCertAssertsNameViaSAN(t *testing.T) {
+	cert := selfSignedCert(t, "legacy-cn", []string{"automation.pcap.internal"})
+	if !certAssertsName(cert, "automation.pcap.internal") {
+		t.Fatalf("expected SAN match to succeed")
+	}
+}
+
+func TestCertAssertsNameFallsBackToCommonName(t *testing.T) {
+	cert := selfSignedCert(t, "automation.pcap.internal", nil)
+	if !certAssertsName(cert, "automation.pcap.internal") {
+		t.Fatalf("expected CN fallback to succeed for a cert with no SANs")
+	}
+}
+
+func TestCertAssertsNameRejectsMismatch(t *testing.T) {
+	cert := selfSignedCert(t, "someone-else", []string{"someone-else.internal"})
+	if certAssertsName(cert, "automation.pcap.internal") {
+		t.Fatalf("expected mismatched name to be rejected")
+	}
+}
+
+func TestPolicyMatch(t *testing.T) {
+	policy := &Policy{
+		Rules: []Rule{
+			{Pattern: "automation.pcap.internal", AllowedAppGUIDs: []string{"app-guid-1"}},
+		},
+	}
+	cert := selfSignedCert(t, "automation.pcap.internal", nil)
+
+	identity, ok := policy.Match(cert)
+	if !ok {
+		t.Fatalf("expected policy to match")
+	}
+	if !identity.CanSeeApp("app-guid-1") {
+		t.Fatalf("expected identity to allow app-guid-1")
+	}
+	if identity.CanSeeApp("app-guid-2") {
+		t.Fatalf("expected identity to reject app-guid-2")
+	}
+}
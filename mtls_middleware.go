@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/domdom82/pcap-server-api/mtls"
+	log "github.com/sirupsen/logrus"
+)
+
+type contextKey string
+
+const identityContextKey contextKey = "mtlsIdentity"
+
+// identityFromContext returns the mTLS identity attached by mtlsMiddleware,
+// if any.
+func identityFromContext(ctx context.Context) (*mtls.Identity, bool) {
+	identity, ok := ctx.Value(identityContextKey).(*mtls.Identity)
+	return identity, ok
+}
+
+// mtlsMiddleware looks up the client certificate presented during the TLS
+// handshake, if any, against the configured policy and attaches the
+// resulting Identity to the request context. It never rejects a request
+// itself: a missing certificate, or one that matches no policy rule, just
+// means no identity is attached, leaving the wrapped handler to fall back
+// to its own CF token check. This makes mTLS additive rather than
+// replacing the existing auth path.
+func (s *Server) mtlsMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(response http.ResponseWriter, request *http.Request) {
+		if s.mtlsPolicy == nil || request.TLS == nil || len(request.TLS.PeerCertificates) == 0 {
+			next(response, request)
+			return
+		}
+
+		cert := request.TLS.PeerCertificates[0]
+		identity, ok := s.mtlsPolicy.Match(cert)
+		if !ok {
+			log.Debugf("client certificate %s matched no mTLS policy rule", cert.Subject.CommonName)
+			next(response, request)
+			return
+		}
+
+		next(response, request.WithContext(context.WithValue(request.Context(), identityContextKey, identity)))
+	}
+}
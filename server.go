@@ -1,55 +1,78 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/json"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"github.com/domdom82/pcap-server-api/cfclient"
 	"github.com/domdom82/pcap-server-api/config"
-	"github.com/google/gopacket"
+	"github.com/domdom82/pcap-server-api/mtls"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcapgo"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
-	"net/url"
+	"os"
+	"os/user"
 	"strconv"
+	"strings"
+	"sync"
 )
 
+// CFClient is the subset of cfclient.Client's behavior Server relies on.
+// It exists so Ginkgo specs can inject a fake implementation instead of
+// spinning up test.MockCfAPI for every test.
+type CFClient interface {
+	GetApp(ctx context.Context, appId string, authToken string) (*cfclient.App, error)
+	GetProcessStats(ctx context.Context, appId string, processType string, authToken string) ([]cfclient.ProcessStats, error)
+	CanUserSeeApp(ctx context.Context, appId string, authToken string) (bool, error)
+	IntrospectToken(ctx context.Context, authToken string) (*cfclient.TokenInfo, error)
+	CCBaseURL() string
+	UAABaseURL() string
+}
+
 type Server struct {
-	httpServer *http.Server
-	config     *config.Config
-	ccBaseURL  string
-	uaaBaseURL string
+	httpServer   *http.Server
+	unixListener net.Listener
+	config       *config.Config
+	cf           CFClient
+	ccBaseURL    string
+	uaaBaseURL   string
+	limiter      *captureLimiter
+	mtlsPolicy   *mtls.Policy
+
+	sessionsMu sync.Mutex
+	sessions   map[string]*captureSession
 }
 
-type cfAPIResponse struct {
-	Links struct {
-		CCv2 struct {
-			Href string `json:"href"`
-		} `json:"cloud_controller_v2"` //nolint:tagliatelle
-		CCv3 struct {
-			Href string `json:"href"`
-		} `json:"cloud_controller_v3"`
-		UAA struct {
-			Href string `json:"href"`
-		} `json:"uaa"`
-	} `json:"links"`
+// registerSession makes a capture session visible to the /stats endpoint.
+func (s *Server) registerSession(cs *captureSession) {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	if s.sessions == nil {
+		s.sessions = make(map[string]*captureSession)
+	}
+	s.sessions[cs.id] = cs
 }
 
-type cfAppResponse struct {
-	GUID string `json:"guid"`
-	Name string `json:"name"`
+// unregisterSession removes a capture session once it has fully stopped.
+func (s *Server) unregisterSession(cs *captureSession) {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	delete(s.sessions, cs.id)
 }
 
-type cfAppStatsResponse struct {
-	Resources []struct {
-		Type  string `json:"type"`
-		Index int    `json:"index"`
-		Host  string `json:"host"`
-	} `json:"resources"`
+func newCaptureID() string {
+	buf := make([]byte, 8)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
 }
 
 func (s *Server) handleHealth(response http.ResponseWriter, request *http.Request) {
@@ -70,6 +93,10 @@ func (s *Server) handleCapture(response http.ResponseWriter, request *http.Reque
 	device := request.URL.Query().Get("device")
 	filter := request.URL.Query().Get("filter")
 	authToken := request.Header.Get("Authorization")
+	format := request.URL.Query().Get("format")
+	if format == "" && strings.Contains(request.Header.Get("Accept"), "pcapng") {
+		format = "pcapng"
+	}
 
 	if appId == "" {
 		response.WriteHeader(http.StatusBadRequest)
@@ -102,28 +129,52 @@ func (s *Server) handleCapture(response http.ResponseWriter, request *http.Reque
 		device = "eth0" // default value
 	}
 
-	if authToken == "" {
+	identity, hasIdentity := identityFromContext(request.Context())
+
+	if authToken == "" && !hasIdentity {
 		response.WriteHeader(http.StatusUnauthorized)
 		response.Write([]byte("authentication required"))
 
 		return
 	}
 
-	// Check if app can be seen by token
-	appVisible, err := s.isAppVisibleByToken(appId, authToken)
-	if err != nil {
-		log.Errorf("could not check if app %s can be seen by token %s (%s)", appId, authToken, err)
-		response.WriteHeader(http.StatusInternalServerError)
+	// An mTLS identity authorized for this specific app is trusted
+	// directly, so that automation can capture without a human CF
+	// session; otherwise fall back to the CF token check.
+	var appVisible bool
+	var err error
+	if hasIdentity && identity.CanSeeApp(appId) {
+		log.Debugf("app %s authorized via mTLS identity %s", appId, identity.CommonName)
+		appVisible = true
+	} else {
+		appVisible, err = s.isAppVisibleByToken(appId, authToken)
+		if err != nil {
+			log.Errorf("could not check if app %s can be seen by token %s (%s)", appId, authToken, err)
+			response.WriteHeader(http.StatusInternalServerError)
 
-		return
+			return
+		}
 	}
-	if appVisible == false {
+	if !appVisible {
 		log.Infof("app %s cannot be seen by token %s", appId, authToken)
 		response.WriteHeader(http.StatusForbidden)
 
 		return
 	}
 
+	limiterKey := cfclient.TokenHash(authToken)
+	if authToken == "" && hasIdentity {
+		limiterKey = "mtls:" + identity.CommonName
+	}
+	if !s.limiter.acquire(limiterKey) {
+		response.Header().Set("Retry-After", "5")
+		response.WriteHeader(http.StatusTooManyRequests)
+		response.Write([]byte("too many concurrent captures"))
+
+		return
+	}
+	defer s.limiter.release(limiterKey)
+
 	handleIOError := func(err error) {
 		if errors.Is(err, io.EOF) {
 			log.Debug("Done capturing.")
@@ -132,58 +183,31 @@ func (s *Server) handleCapture(response http.ResponseWriter, request *http.Reque
 		}
 	}
 
-	type packetMessage struct {
-		packet gopacket.Packet
-		done   bool
-	}
-	packets := make(chan packetMessage, 1000)
-
+	cs := newCaptureSession(s, newCaptureID(), appId, appType, device, filter, authToken)
+	s.registerSession(cs)
+	defer s.unregisterSession(cs)
 	for _, index := range appIndices {
-		go func(appIndex int, packets chan packetMessage) {
-			defer func() {
-				packets <- packetMessage{
-					packet: nil,
-					done:   true,
-				}
-			}()
-			// App is visible? Great! Let's find out where it lives
-			appLocation, err := s.getAppLocation(appId, appIndex, appType, authToken)
-			if err != nil {
-				log.Errorf("could not get location of app %s index %d of type %s (%s)", appId, appIndex, appType, err)
-				return
-			}
-			// We found the app's location? Nice! Let's contact the pcap-Server on that VM (index only needed for testing)
-			pcapServerURL := fmt.Sprintf("https://%s:%s/capture?appid=%s&index=%d&device=%s&filter=%s", appLocation, s.config.PcapServerPort, appId, appIndex, device, filter)
-			pcapStream, err := s.getPcapStream(pcapServerURL)
-			defer pcapStream.Close()
-			if err != nil {
-				log.Errorf("could not get pcap stream from URL %s (%s)", pcapServerURL, err)
-				response.WriteHeader(http.StatusBadGateway)
-				return
-			}
+		cs.addIndex(index)
+	}
+	defer cs.stop()
+
+	// Wait for the first real packet (or for every index to give up)
+	// before writing any response headers, so a total failure - e.g. the
+	// upstream pcap-server was unreachable for every index - can be
+	// reported as a real error status instead of silently returning an
+	// empty 200 OK.
+	first, hasFirst, done, workerErr := cs.awaitFirstPacket(len(appIndices))
+	if !hasFirst && workerErr != nil {
+		log.Errorf("capture of app %s failed before any data arrived: %s", appId, workerErr)
+		response.WriteHeader(http.StatusBadGateway)
+		response.Write([]byte(fmt.Sprintf("could not capture app %s: %s", appId, workerErr)))
+		return
+	}
 
-			// Stream the pcap back to the client
-			pcapReader, err := pcapgo.NewReader(pcapStream)
-			if err != nil {
-				log.Errorf("could not create pcap reader from pcap stream %s (%s)", pcapStream, err)
-				response.WriteHeader(http.StatusBadGateway)
-				return
-			}
-			for {
-				data, capInfo, err := pcapReader.ReadPacketData()
-				if err != nil {
-					handleIOError(err)
-					return
-				}
-				log.Debugf("Read packet: Time %s Length %d Captured %d", capInfo.Timestamp, capInfo.Length, capInfo.CaptureLength)
-				packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
-				packet.Metadata().CaptureInfo = capInfo
-				packets <- packetMessage{
-					packet: packet,
-					done:   false,
-				}
-			}
-		}(index, packets)
+	if format == "pcapng" {
+		response.Header().Set("Content-Type", "application/x-pcapng")
+		s.writePcapNG(response, cs, appId, filter, appIndices, request, first, hasFirst, done)
+		return
 	}
 
 	// Collect all packets from multiple input streams and merge them into one output stream
@@ -195,8 +219,22 @@ func (s *Server) handleCapture(response http.ResponseWriter, request *http.Reque
 	}
 
 	bytesTotal := 24 // pcap header is 24 bytes
-	done := 0
-	for msg := range packets {
+	if !hasFirst {
+		// Every index finished without ever producing a packet, but none
+		// of them errored either (otherwise we'd have returned above) -
+		// still a successful capture, just an empty one.
+		log.Infof("Done capturing. Wrote %d bytes from %s to %s", bytesTotal, request.URL, request.RemoteAddr)
+		return
+	}
+	if err := w.WritePacket(first.packet.Metadata().CaptureInfo, first.packet.Data()); err != nil {
+		handleIOError(err)
+		return
+	}
+	bytesTotal += first.packet.Metadata().Length
+	if f, ok := response.(http.Flusher); ok {
+		f.Flush()
+	}
+	for msg := range cs.packets {
 		if msg.packet != nil {
 			err = w.WritePacket(msg.packet.Metadata().CaptureInfo, msg.packet.Data())
 			if err != nil {
@@ -218,7 +256,12 @@ func (s *Server) handleCapture(response http.ResponseWriter, request *http.Reque
 	}
 }
 
-func (s *Server) getPcapStream(pcapServerURL string) (io.ReadCloser, error) {
+// getPcapStream opens the upstream pcap-server connection for the given URL.
+// ctx is wired into the outbound request so that cancelling it (e.g. a
+// capture worker being removed mid-stream via removeIndex) aborts the
+// connection and unblocks a caller currently stuck in a read on the
+// returned body, rather than leaving it to linger until more data arrives.
+func (s *Server) getPcapStream(ctx context.Context, pcapServerURL string) (io.ReadCloser, error) {
 	// TODO possibly move this into a pcapServerClient type
 	log.Debugf("Getting pcap stream from %s", pcapServerURL)
 	cert, err := tls.LoadX509KeyPair(s.config.PcapServerClientCert, s.config.PcapServerClientKey)
@@ -244,7 +287,12 @@ func (s *Server) getPcapStream(pcapServerURL string) (io.ReadCloser, error) {
 		},
 	}
 
-	res, err := client.Get(pcapServerURL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pcapServerURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := client.Do(req)
 
 	if err != nil {
 		return nil, err
@@ -256,48 +304,20 @@ func (s *Server) getPcapStream(pcapServerURL string) (io.ReadCloser, error) {
 	return res.Body, nil
 }
 
-func (s *Server) getAppLocation(appId string, appIndex int, appType string, authToken string) (string, error) {
-	// FIXME refactor with isAppVisibleByToken into common cf client that uses authToken
+func (s *Server) getAppLocation(ctx context.Context, appId string, appIndex int, appType string, authToken string) (string, error) {
 	log.Debugf("Trying to get location of app %s with index %d of type %s", appId, appIndex, appType)
-	httpClient := http.DefaultClient
-	appURL, err := url.Parse(fmt.Sprintf("%s/apps/%s/processes/%s/stats", s.ccBaseURL, appId, appType))
-
-	if err != nil {
-		return "", err
-	}
-	req := &http.Request{
-		Method: "GET",
-		URL:    appURL,
-		Header: map[string][]string{
-			"Authorization": {authToken},
-		},
-	}
-
-	res, err := httpClient.Do(req)
-
-	if err != nil {
-		return "", err
-	}
-	if res.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("expected status code %d but got status code %d", http.StatusOK, res.StatusCode)
-	}
 
-	var appStatsResponse *cfAppStatsResponse
-	data, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return "", err
-	}
-	err = json.Unmarshal(data, &appStatsResponse)
+	stats, err := s.cf.GetProcessStats(ctx, appId, appType, authToken)
 	if err != nil {
 		return "", err
 	}
 
-	if len(appStatsResponse.Resources) < appIndex+1 {
+	if len(stats) < appIndex+1 {
 		return "", fmt.Errorf("expected at least %d elements in stats array for app %s with index %d of type %s but got %d",
-			appIndex+1, appId, appIndex, appType, len(appStatsResponse.Resources))
+			appIndex+1, appId, appIndex, appType, len(stats))
 	}
 
-	for _, process := range appStatsResponse.Resources {
+	for _, process := range stats {
 		if process.Index == appIndex {
 			if process.Type == appType {
 				return process.Host, nil
@@ -310,66 +330,61 @@ func (s *Server) getAppLocation(appId string, appIndex int, appType string, auth
 
 func (s *Server) isAppVisibleByToken(appId string, authToken string) (bool, error) {
 	log.Debugf("Checking at %s if app %s can be seen by token %s", s.ccBaseURL, appId, authToken)
-	httpClient := http.DefaultClient
-	appURL, err := url.Parse(fmt.Sprintf("%s/apps/%s", s.ccBaseURL, appId))
+	return s.cf.CanUserSeeApp(context.Background(), appId, authToken)
+}
 
-	if err != nil {
-		return false, err
-	}
-	req := &http.Request{
-		Method: "GET",
-		URL:    appURL,
-		Header: map[string][]string{
-			"Authorization": {authToken},
-		},
-	}
+// getApp fetches the app's CC metadata (currently just guid/name), used to
+// populate the pcapng Section Header Block comment.
+func (s *Server) getApp(appId string, authToken string) (*cfclient.App, error) {
+	return s.cf.GetApp(context.Background(), appId, authToken)
+}
 
-	res, err := httpClient.Do(req)
-	if err != nil {
-		return false, err
-	}
-	if res.StatusCode != http.StatusOK {
-		return false, fmt.Errorf("expected status code %d but got status code %d", http.StatusOK, res.StatusCode)
-	}
+func (s *Server) setup() {
+	s.limiter = newCaptureLimiter(s.config.MaxConcurrentCapturesPerToken, s.config.MaxConcurrentCapturesGlobal)
 
-	var appResponse *cfAppResponse
-	data, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return false, err
-	}
-	err = json.Unmarshal(data, &appResponse)
-	if err != nil {
-		return false, err
+	if s.cf != nil {
+		// A CFClient was already injected (e.g. by NewServerWithCFClient in
+		// tests), so there is nothing left to discover.
+		s.ccBaseURL = s.cf.CCBaseURL()
+		s.uaaBaseURL = s.cf.UAABaseURL()
+		return
 	}
 
-	if appResponse.GUID != appId {
-		return false, fmt.Errorf("expected app id %s but got app id %s (%s)", appId, appResponse.GUID, appResponse.Name)
+	cf, err := cfclient.New(context.Background(), s.config.CfAPI, cfclient.DefaultOptions())
+	if err != nil {
+		log.Fatalf("Could not set up CF API client: %s", err)
 	}
 
-	return true, nil
+	s.cf = cf
+	s.ccBaseURL = cf.CCBaseURL()
+	s.uaaBaseURL = cf.UAABaseURL()
 }
 
-func (s *Server) setup() {
-	log.Info("Discovering CF API endpoints...")
-	response, err := http.Get(s.config.CfAPI)
-
+// setupMTLS loads the client CA bundle and policy file and arms
+// s.httpServer to accept (but not require) a client certificate, so mTLS is
+// additive to the existing CF token auth rather than a replacement for it.
+func (s *Server) setupMTLS() error {
+	caCert, err := ioutil.ReadFile(s.config.MTLSClientCACert)
 	if err != nil {
-		log.Fatalf("Could not fetch CF API from %s (%s)", s.config.CfAPI, err)
+		return fmt.Errorf("could not read mTLS client CA bundle: %w", err)
+	}
+	caPool := x509.NewCertPool()
+	if !caPool.AppendCertsFromPEM(caCert) {
+		return fmt.Errorf("no certificates found in mTLS client CA bundle %s", s.config.MTLSClientCACert)
 	}
 
-	var apiResponse *cfAPIResponse
-	data, err := ioutil.ReadAll(response.Body)
+	policy, err := mtls.LoadPolicy(s.config.MTLSPolicyFile)
 	if err != nil {
-		log.Fatalf("Could not read CF API response: %s", err)
+		return fmt.Errorf("could not load mTLS policy file: %w", err)
 	}
-	err = json.Unmarshal(data, &apiResponse)
-	if err != nil {
-		log.Fatalf("Could not parse CF API response: %s", err)
+	s.mtlsPolicy = policy
+
+	s.httpServer.TLSConfig = &tls.Config{
+		ClientCAs:  caPool,
+		ClientAuth: tls.VerifyClientCertIfGiven,
 	}
 
-	s.ccBaseURL = apiResponse.Links.CCv3.Href
-	s.uaaBaseURL = apiResponse.Links.UAA.Href
-	log.Info("Done.")
+	return nil
 }
 
 func (s *Server) Run() {
@@ -379,7 +394,11 @@ func (s *Server) Run() {
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/health", s.handleHealth)
-	mux.HandleFunc("/capture", s.handleCapture)
+	mux.HandleFunc("/capture", s.mtlsMiddleware(s.handleCapture))
+	mux.HandleFunc("/capture/ws", s.mtlsMiddleware(s.handleCaptureWS))
+	mux.HandleFunc("/stats", s.handleStats)
+	mux.HandleFunc("/captures", s.handleCaptures)
+	mux.Handle("/metrics", promhttp.Handler())
 	log.Info("Starting CLI file Server at root " + s.config.CLIDownloadRoot)
 	mux.Handle("/cli/", http.StripPrefix("/cli/", http.FileServer(http.Dir(s.config.CLIDownloadRoot))))
 
@@ -388,17 +407,121 @@ func (s *Server) Run() {
 		Handler: mux,
 	}
 
-	log.Infof("Listening on %s ...", s.config.Listen)
-	if s.config.EnableServerTLS {
-		log.Info(s.httpServer.ListenAndServeTLS(s.config.Cert, s.config.Key))
-	} else {
-		log.Info(s.httpServer.ListenAndServe())
+	if s.config.MTLSEnabled {
+		if err := s.setupMTLS(); err != nil {
+			log.Fatalf("Could not set up mTLS: %s", err)
+		}
+	}
+
+	results := make(chan error, 2)
+	listeners := 0
+
+	if s.config.ListenSocket != "" {
+		listener, err := s.listenUnixSocket()
+		if err != nil {
+			log.Fatalf("Could not listen on unix socket %s: %s", s.config.ListenSocket, err)
+		}
+		s.unixListener = listener
+		listeners++
+		go func() {
+			log.Infof("Listening on unix socket %s ...", s.config.ListenSocket)
+			results <- s.httpServer.Serve(listener)
+		}()
+	}
+
+	if s.config.Listen != "" {
+		listeners++
+		go func() {
+			log.Infof("Listening on %s ...", s.config.Listen)
+			if s.config.EnableServerTLS {
+				results <- s.httpServer.ListenAndServeTLS(s.config.Cert, s.config.Key)
+			} else {
+				results <- s.httpServer.ListenAndServe()
+			}
+		}()
+	}
+
+	for i := 0; i < listeners; i++ {
+		log.Info(<-results)
 	}
 }
 
+// listenUnixSocket creates the configured unix domain socket, removing a
+// stale one left behind by a previous run, and applies the configured
+// permissions/ownership so co-located tooling (nginx, envoy) can connect to
+// it without exposing a TCP port.
+func (s *Server) listenUnixSocket() (net.Listener, error) {
+	socketPath := s.config.ListenSocket
+
+	if _, err := os.Stat(socketPath); err == nil {
+		log.Warnf("Removing stale unix socket at %s", socketPath)
+		if err := os.Remove(socketPath); err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.config.SocketMode != "" {
+		mode, err := strconv.ParseUint(s.config.SocketMode, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SocketMode %q: %w", s.config.SocketMode, err)
+		}
+		if err := os.Chmod(socketPath, os.FileMode(mode)); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.config.SocketOwner != "" {
+		uid, gid, err := lookupSocketOwner(s.config.SocketOwner)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chown(socketPath, uid, gid); err != nil {
+			return nil, err
+		}
+	}
+
+	return listener, nil
+}
+
+// lookupSocketOwner resolves a "user" or "user:group" spec to numeric
+// uid/gid, defaulting gid to the user's primary group when unspecified.
+func lookupSocketOwner(spec string) (uid int, gid int, err error) {
+	parts := strings.SplitN(spec, ":", 2)
+
+	u, err := user.Lookup(parts[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	uid, err = strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if len(parts) == 1 {
+		gid, err = strconv.Atoi(u.Gid)
+		return uid, gid, err
+	}
+
+	g, err := user.LookupGroup(parts[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	gid, err = strconv.Atoi(g.Gid)
+
+	return uid, gid, err
+}
+
 func (s *Server) Stop() {
 	log.Info("PcapServer-API stopping...")
 	_ = s.httpServer.Close()
+	if s.unixListener != nil {
+		_ = os.Remove(s.config.ListenSocket)
+	}
 }
 
 func NewServer(c *config.Config) (*Server, error) {
@@ -411,3 +534,18 @@ func NewServer(c *config.Config) (*Server, error) {
 
 	return server, nil
 }
+
+// NewServerWithCFClient is like NewServer but lets the caller supply the
+// CFClient up front instead of having one discovered from config.CfAPI on
+// Run(). Ginkgo specs use this to inject a fake CFClient so they don't need
+// to spin up test.MockCfAPI for tests that don't care about the real HTTP
+// round trip.
+func NewServerWithCFClient(c *config.Config, cf CFClient) (*Server, error) {
+	server, err := NewServer(c)
+	if err != nil {
+		return nil, err
+	}
+	server.cf = cf
+
+	return server, nil
+}
@@ -1,19 +1,60 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"fmt"
+	"github.com/domdom82/pcap-server-api/cfclient"
 	"github.com/domdom82/pcap-server-api/config"
+	"github.com/domdom82/pcap-server-api/mtls"
 	"github.com/domdom82/pcap-server-api/test"
+	"github.com/google/gopacket/pcapgo"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"io"
+	"math/big"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
 
+// fakeCFClient is a CFClient that never makes a real HTTP request, used to
+// exercise Server without spinning up test.MockCfAPI.
+type fakeCFClient struct {
+	app        *cfclient.App
+	stats      []cfclient.ProcessStats
+	visible    bool
+	visibleErr error
+}
+
+func (f *fakeCFClient) GetApp(ctx context.Context, appId string, authToken string) (*cfclient.App, error) {
+	return f.app, nil
+}
+
+func (f *fakeCFClient) GetProcessStats(ctx context.Context, appId string, processType string, authToken string) ([]cfclient.ProcessStats, error) {
+	return f.stats, nil
+}
+
+func (f *fakeCFClient) CanUserSeeApp(ctx context.Context, appId string, authToken string) (bool, error) {
+	return f.visible, f.visibleErr
+}
+
+func (f *fakeCFClient) IntrospectToken(ctx context.Context, authToken string) (*cfclient.TokenInfo, error) {
+	return &cfclient.TokenInfo{Active: true}, nil
+}
+
+func (f *fakeCFClient) CCBaseURL() string { return "https://cc.fake" }
+func (f *fakeCFClient) UAABaseURL() string { return "https://uaa.fake" }
+
 func TestPcapServerApi(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Pcap Server API")
@@ -106,31 +147,31 @@ var _ = Describe("Single Target Capture Tests", func() {
 	})
 	Context("Getting app location", func() {
 		It("Returns an address that hosts the target app", func() {
-			location, err := server.getAppLocation("1234", 0, "web", "mytoken")
+			location, err := server.getAppLocation(context.Background(), "1234", 0, "web", "mytoken")
 			Expect(err).To(BeNil())
 			Expect(location).To(Equal(pcapServer.Host))
 		})
 		It("Returns an error for invisible apps", func() {
-			location, err := server.getAppLocation("9999", 0, "web", "mytoken")
+			location, err := server.getAppLocation(context.Background(), "9999", 0, "web", "mytoken")
 			Expect(err).NotTo(BeNil())
 			Expect(location).To(Equal(""))
 		})
 	})
 	Context("Getting pcap stream for an app", func() {
 		It("Returns an stream for the target app", func() {
-			location, err := server.getAppLocation("1234", 0, "web", "mytoken")
+			location, err := server.getAppLocation(context.Background(), "1234", 0, "web", "mytoken")
 			Expect(err).To(BeNil())
 			Expect(location).To(Equal(pcapServer.Host))
-			pcapStream, err := server.getPcapStream(
+			pcapStream, err := server.getPcapStream(context.Background(),
 				fmt.Sprintf("https://%s:%s/capture?appid=1234&index=0&device=eth0&filter=", location, pcapServer.Port))
 			Expect(err).To(BeNil())
 			Expect(pcapStream).NotTo(BeNil())
 		})
 		It("Returns an error for streams of invisible apps", func() {
-			location, err := server.getAppLocation("9999", 0, "web", "mytoken")
+			location, err := server.getAppLocation(context.Background(), "9999", 0, "web", "mytoken")
 			Expect(err).NotTo(BeNil())
 			Expect(location).To(Equal(""))
-			pcapStream, err := server.getPcapStream(
+			pcapStream, err := server.getPcapStream(context.Background(),
 				fmt.Sprintf("https://%s:%s/capture?appid=9999&index=0&filter=", pcapServer.Host, pcapServer.Port))
 			Expect(err).NotTo(BeNil())
 			Expect(pcapStream).To(Equal(http.NoBody))
@@ -169,8 +210,221 @@ var _ = Describe("Single Target Capture Tests", func() {
 			Expect(err).To(BeNil())
 			Expect(infoDst.Size()).To(Equal(infoSrc.Size()))
 		})
+		It("Reports a BadGateway instead of an empty 200 when the app's instance can't be located", func() {
+			badAppURL, _ := url.Parse("http://localhost:8080/capture?appid=1234&index=9&filter=")
+			badReq := &http.Request{
+				Method: "GET",
+				URL:    badAppURL,
+				Header: map[string][]string{
+					"Authorization": {"myToken"},
+				},
+			}
+			res, err := client.Do(badReq)
+			Expect(err).To(BeNil())
+			Expect(res.StatusCode).To(Equal(http.StatusBadGateway))
+		})
+	})
+
+	Context("Streaming pcap to disk for an app in pcapng format", func() {
+		client := http.DefaultClient
+		appURL, _ := url.Parse("http://localhost:8080/capture?appid=1234&filter=&format=pcapng")
+		req := &http.Request{
+			Method: "GET",
+			URL:    appURL,
+			Header: map[string][]string{
+				"Authorization": {"myToken"},
+			},
+		}
+
+		It("Writes a pcapng section header block instead of a legacy pcap header", func() {
+			res, err := client.Do(req)
+			Expect(err).To(BeNil())
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(res.Header.Get("Content-Type")).To(Equal("application/x-pcapng"))
+			magic := make([]byte, 4)
+			_, err = io.ReadFull(res.Body, magic)
+			Expect(err).To(BeNil())
+			Expect(magic).To(Equal([]byte{0x0a, 0x0d, 0x0d, 0x0a}))
+		})
+	})
+
+})
+
+var _ = Describe("CF Client Injection Tests", func() {
+	var server *Server
+	var err error
+	cfg := config.DefaultConfig
+	fake := &fakeCFClient{
+		app:     &cfclient.App{GUID: "1234", Name: "my-app"},
+		visible: true,
+	}
+
+	BeforeEach(func() {
+		server, err = NewServerWithCFClient(&cfg, fake)
+		Expect(err).To(BeNil())
+		go server.Run()
+		time.Sleep(100 * time.Millisecond)
+	})
+	AfterEach(func() {
+		server.Stop()
+	})
+
+	Context("When a fake CFClient is injected instead of a real one", func() {
+		It("uses the fake for visibility checks without any HTTP discovery", func() {
+			visible, err := server.isAppVisibleByToken("1234", "mytoken")
+			Expect(err).To(BeNil())
+			Expect(visible).To(BeTrue())
+			Expect(server.ccBaseURL).To(Equal("https://cc.fake"))
+		})
+	})
+})
+
+var _ = Describe("Unix Domain Socket Tests", func() {
+	cfAPI := test.MockCfAPI(nil)
+	var server *Server
+	var err error
+	socketPath := filepath.Join(os.TempDir(), "pcap-server-api-test.sock")
+
+	cfg := config.DefaultConfig
+	cfg.CfAPI = cfAPI.URL
+	cfg.Listen = ""
+	cfg.ListenSocket = socketPath
+	cfg.SocketMode = "0600"
+
+	BeforeEach(func() {
+		server, err = NewServer(&cfg)
+		Expect(err).To(BeNil())
+		go server.Run()
+		time.Sleep(100 * time.Millisecond)
+	})
+	AfterEach(func() {
+		server.Stop()
+	})
+
+	Context("When ListenSocket is configured instead of a TCP address", func() {
+		It("serves the mux over the unix socket", func() {
+			client := http.Client{
+				Transport: &http.Transport{
+					DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+						return net.Dial("unix", socketPath)
+					},
+				},
+			}
+			r, err := client.Get("http://unix/health")
+			Expect(err).To(BeNil())
+			Expect(r.StatusCode).To(Equal(200))
+		})
+		It("applies the configured socket mode", func() {
+			info, err := os.Stat(socketPath)
+			Expect(err).To(BeNil())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+		})
+	})
+})
+
+var _ = Describe("Capture Limiter Tests", func() {
+	Context("Enforcing MaxConcurrentCapturesPerToken and MaxConcurrentCapturesGlobal", func() {
+		It("rejects a token once it is at its per-token limit", func() {
+			limiter := newCaptureLimiter(1, 10)
+			Expect(limiter.acquire("token-a")).To(BeTrue())
+			Expect(limiter.acquire("token-a")).To(BeFalse())
+			limiter.release("token-a")
+			Expect(limiter.acquire("token-a")).To(BeTrue())
+		})
+		It("rejects any token once the global limit is reached", func() {
+			limiter := newCaptureLimiter(10, 1)
+			Expect(limiter.acquire("token-a")).To(BeTrue())
+			Expect(limiter.acquire("token-b")).To(BeFalse())
+			limiter.release("token-a")
+			Expect(limiter.acquire("token-b")).To(BeTrue())
+		})
+		It("treats a limit of zero as unlimited", func() {
+			limiter := newCaptureLimiter(0, 0)
+			for i := 0; i < 100; i++ {
+				Expect(limiter.acquire("token-a")).To(BeTrue())
+			}
+		})
+	})
+})
+
+var _ = Describe("mTLS Middleware Tests", func() {
+	selfSignedCert := func(commonName string, dnsNames []string) *x509.Certificate {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).To(BeNil())
+
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: commonName},
+			DNSNames:     dnsNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		Expect(err).To(BeNil())
+
+		cert, err := x509.ParseCertificate(der)
+		Expect(err).To(BeNil())
+
+		return cert
+	}
+
+	var server *Server
+
+	BeforeEach(func() {
+		cfg := config.DefaultConfig
+		fake := &fakeCFClient{visible: false, visibleErr: fmt.Errorf("app not visible")}
+		var err error
+		server, err = NewServerWithCFClient(&cfg, fake)
+		Expect(err).To(BeNil())
+		server.limiter = newCaptureLimiter(0, 0)
+		server.mtlsPolicy = &mtls.Policy{
+			Rules: []mtls.Rule{
+				{Pattern: "automation.pcap.internal", AllowedAppGUIDs: []string{"1234"}},
+			},
+		}
+	})
+
+	Context("When a request carries a client certificate matching a policy rule", func() {
+		It("attaches an Identity to the request context", func() {
+			cert := selfSignedCert("automation.pcap.internal", nil)
+			req := httptest.NewRequest("GET", "/capture?appid=1234", nil)
+			req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+
+			var seen *mtls.Identity
+			handler := server.mtlsMiddleware(func(response http.ResponseWriter, request *http.Request) {
+				identity, _ := identityFromContext(request.Context())
+				seen = identity
+			})
+			handler(httptest.NewRecorder(), req)
+
+			Expect(seen).NotTo(BeNil())
+			Expect(seen.CanSeeApp("1234")).To(BeTrue())
+		})
+
+		It("lets handleCapture authorize the app without a CF token", func() {
+			cert := selfSignedCert("automation.pcap.internal", nil)
+			req := httptest.NewRequest("GET", "/capture?appid=1234", nil)
+			req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+
+			recorder := httptest.NewRecorder()
+			server.mtlsMiddleware(server.handleCapture)(recorder, req)
+
+			Expect(recorder.Code).NotTo(Equal(http.StatusUnauthorized))
+			Expect(recorder.Code).NotTo(Equal(http.StatusForbidden))
+		})
 	})
 
+	Context("When a request carries no client certificate", func() {
+		It("leaves the request unauthenticated, falling back to the CF token check", func() {
+			req := httptest.NewRequest("GET", "/capture?appid=1234", nil)
+
+			recorder := httptest.NewRecorder()
+			server.mtlsMiddleware(server.handleCapture)(recorder, req)
+
+			Expect(recorder.Code).To(Equal(http.StatusUnauthorized))
+		})
+	})
 })
 
 var _ = Describe("Multiple Target Capture Tests", func() {
@@ -240,4 +494,46 @@ var _ = Describe("Multiple Target Capture Tests", func() {
 			Expect(infoDst.Size()).To(Equal(infoSrc1.Size() + infoSrc2.Size() - 24))
 		})
 	})
+
+	Context("Streaming pcap to disk for an app in pcapng format with multiple instances", func() {
+		client := http.DefaultClient
+		appURL, _ := url.Parse("http://localhost:8080/capture?appid=1234&index=0&index=1&filter=&format=pcapng")
+		req := &http.Request{
+			Method: "GET",
+			URL:    appURL,
+			Header: map[string][]string{
+				"Authorization": {"myToken"},
+			},
+		}
+
+		It("Writes one Interface Description Block per app index and tags each packet with its own interface", func() {
+			res, err := client.Do(req)
+			Expect(err).To(BeNil())
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			defer res.Body.Close()
+
+			ngReader, err := pcapgo.NewNgReader(res.Body, pcapgo.DefaultNgReaderOptions)
+			Expect(err).To(BeNil())
+
+			Expect(ngReader.NInterfaces()).To(Equal(2))
+			iface0, err := ngReader.Interface(0)
+			Expect(err).To(BeNil())
+			iface1, err := ngReader.Interface(1)
+			Expect(err).To(BeNil())
+			Expect(iface0.Name).To(Equal("app-1234-idx-0-eth0"))
+			Expect(iface1.Name).To(Equal("app-1234-idx-1-eth0"))
+
+			seenInterfaces := map[int]bool{}
+			for {
+				_, capInfo, err := ngReader.ReadPacketData()
+				if err == io.EOF {
+					break
+				}
+				Expect(err).To(BeNil())
+				seenInterfaces[capInfo.InterfaceIndex] = true
+			}
+			Expect(seenInterfaces).To(HaveKey(0))
+			Expect(seenInterfaces).To(HaveKey(1))
+		})
+	})
 })